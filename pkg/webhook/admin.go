@@ -0,0 +1,51 @@
+/*
+Copyright 2018 The Knative Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// AdminDumpPath is the read-only endpoint operators can hit to see every
+// validation and defaulting rule currently registered with the webhook,
+// without reading source.
+const AdminDumpPath = "/admin/dump"
+
+// dumpResponse is the body returned from AdminDumpPath: every registered
+// RuleRegistry, sorted by GVK for a stable response.
+type dumpResponse struct {
+	Registries []*RuleRegistry `json:"registries"`
+}
+
+// DumpHandler serves AdminDumpPath with a JSON description of every
+// validator and defaulter registered through registerRules.
+func DumpHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := dumpResponse{}
+		for _, reg := range registries {
+			resp.Registries = append(resp.Registries, reg)
+		}
+		sort.Slice(resp.Registries, func(i, j int) bool {
+			return resp.Registries[i].GVK.String() < resp.Registries[j].GVK.String()
+		})
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2018 The Knative Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"github.com/knative/serving/pkg/apis/serving/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	// serviceGVKV1Alpha1 is the GroupVersionKind of v1alpha1.Service, used to
+	// tag audit events and rule-registry entries for that API version.
+	serviceGVKV1Alpha1 = v1alpha1.SchemeGroupVersion.WithKind("Service")
+	// serviceGVKV1Beta1 is the GroupVersionKind of v1beta1.Service, used to
+	// tag audit events and rule-registry entries for that API version.
+	serviceGVKV1Beta1 = v1beta1.SchemeGroupVersion.WithKind("Service")
+)
+
+// admittedGVKs lists every GroupVersionKind this webhook validates and
+// defaults. Both v1alpha1 and v1beta1 Service are registered here so a
+// single webhook deployment can serve both versions at once.
+var admittedGVKs = []schema.GroupVersionKind{
+	serviceGVKV1Alpha1,
+	serviceGVKV1Beta1,
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2018 The Knative Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"github.com/mattbaird/jsonpatch"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// auditSinkEnvVar names the env var (set from a ConfigMap key by the
+	// deployment) that points the webhook at its audit event sink: either
+	// an HTTP(S) endpoint or the literal value "stdout".
+	auditSinkEnvVar = "WEBHOOK_AUDIT_SINK"
+
+	auditEventBufferSize   = 256
+	cloudEventsSpecVersion = "1.0"
+	webhookSourceURI       = "knative.dev/serving/webhook"
+
+	eventTypeValidated = "dev.knative.serving.webhook.service.validated"
+	eventTypeRejected  = "dev.knative.serving.webhook.service.rejected"
+	eventTypeDefaulted = "dev.knative.serving.webhook.service.defaulted"
+)
+
+// AuditSink delivers a single marshaled CloudEvents v1.0 event. Sends must
+// not block the emitter for long; a slow or unreachable sink only delays
+// delivery of queued events, never the admission request that produced
+// them.
+type AuditSink interface {
+	Send(event []byte)
+}
+
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpAuditSink) Send(event []byte) {
+	resp, err := s.client.Post(s.url, "application/cloudevents+json", bytes.NewReader(event))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+type stdoutAuditSink struct{}
+
+func (stdoutAuditSink) Send(event []byte) {
+	log.Printf("webhook audit event: %s", event)
+}
+
+func sinkFromEnv() AuditSink {
+	url := os.Getenv(auditSinkEnvVar)
+	if url == "" || url == "stdout" {
+		return stdoutAuditSink{}
+	}
+	return &httpAuditSink{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// auditEvent is a CloudEvents v1.0 envelope describing a single admission
+// decision made by this webhook.
+type auditEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+type rejectionData struct {
+	GVK      string   `json:"gvk"`
+	Paths    []string `json:"paths"`
+	Message  string   `json:"message"`
+	UserInfo string   `json:"userInfo,omitempty"`
+}
+
+type acceptedData struct {
+	GVK      string `json:"gvk"`
+	UserInfo string `json:"userInfo,omitempty"`
+}
+
+type defaultedData struct {
+	GVK      string                         `json:"gvk"`
+	Patches  []jsonpatch.JsonPatchOperation `json:"patches"`
+	UserInfo string                         `json:"userInfo,omitempty"`
+}
+
+// auditEmitter buffers admission audit events and delivers them to an AuditSink
+// from a single background goroutine. The buffer is bounded: once full,
+// the oldest queued event is dropped to make room for the newest one, so
+// a stalled sink can never add latency to the admission request path.
+type auditEmitter struct {
+	sink   AuditSink
+	events chan auditEvent
+}
+
+func newAuditEmitter(sink AuditSink) *auditEmitter {
+	e := &auditEmitter{
+		sink:   sink,
+		events: make(chan auditEvent, auditEventBufferSize),
+	}
+	go e.run()
+	return e
+}
+
+func (e *auditEmitter) run() {
+	for ev := range e.events {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		e.sink.Send(body)
+	}
+}
+
+func (e *auditEmitter) emit(ev auditEvent) {
+	select {
+	case e.events <- ev:
+		return
+	default:
+	}
+	// The buffer is full: drop the oldest event to make room, best effort.
+	select {
+	case <-e.events:
+	default:
+	}
+	select {
+	case e.events <- ev:
+	default:
+	}
+}
+
+var defaultEmitter = newAuditEmitter(sinkFromEnv())
+
+var eventCounter int64
+
+func nextEventID() string {
+	n := atomic.AddInt64(&eventCounter, 1)
+	return fmt.Sprintf("%d.%d", time.Now().UnixNano(), n)
+}
+
+type auditContextKey struct{}
+
+// WithUserInfo attaches the admission request's user info to ctx so it can
+// be included in the audit event the validator or defaulter emits. The
+// validator closures returned by ValidateService and ValidateServiceV1Beta1
+// read it from the context they are invoked with; the defaulter closures
+// returned by SetServiceDefaults and SetServiceDefaultsV1Beta1 take no
+// context and read it from the context passed to SetServiceDefaults or
+// SetServiceDefaultsV1Beta1. Without it, audit events carry an empty
+// UserInfo.
+func WithUserInfo(ctx context.Context, userInfo string) context.Context {
+	return context.WithValue(ctx, auditContextKey{}, userInfo)
+}
+
+func userInfoFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if userInfo, ok := ctx.Value(auditContextKey{}).(string); ok {
+		return userInfo
+	}
+	return ""
+}
+
+// emitValidationAudit records an admission decision made by ValidateService
+// as a "validated" or "rejected" CloudEvent.
+func emitValidationAudit(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string, ferr *v1alpha1.FieldError) {
+	ev := auditEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              nextEventID(),
+		Source:          webhookSourceURI,
+		Subject:         namespace + "/" + name,
+		Time:            time.Now(),
+		DataContentType: "application/json",
+	}
+	if ferr != nil {
+		ev.Type = eventTypeRejected
+		ev.Data = rejectionData{
+			GVK:      gvk.String(),
+			Paths:    ferr.Paths,
+			Message:  ferr.Message,
+			UserInfo: userInfoFromContext(ctx),
+		}
+	} else {
+		ev.Type = eventTypeValidated
+		ev.Data = acceptedData{
+			GVK:      gvk.String(),
+			UserInfo: userInfoFromContext(ctx),
+		}
+	}
+	defaultEmitter.emit(ev)
+}
+
+// emitDefaultedAudit records the JSON patches produced by SetServiceDefaults
+// as a "defaulted" CloudEvent. Nothing is emitted when defaulting made no
+// changes.
+func emitDefaultedAudit(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string, patches []jsonpatch.JsonPatchOperation) {
+	if len(patches) == 0 {
+		return
+	}
+	defaultEmitter.emit(auditEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              nextEventID(),
+		Source:          webhookSourceURI,
+		Type:            eventTypeDefaulted,
+		Subject:         namespace + "/" + name,
+		Time:            time.Now(),
+		DataContentType: "application/json",
+		Data: defaultedData{
+			GVK:      gvk.String(),
+			Patches:  patches,
+			UserInfo: userInfoFromContext(ctx),
+		},
+	})
+}
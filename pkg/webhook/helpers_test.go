@@ -0,0 +1,93 @@
+/*
+Copyright 2018 The Knative Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// createConfiguration builds a fully formed Configuration for use in
+// tests, with the autoscaling annotations already set to the values a
+// previous round of defaulting would have produced.
+func createConfiguration(generation int64, name string) v1alpha1.Configuration {
+	return v1alpha1.Configuration{
+		Spec: v1alpha1.ConfigurationSpec{
+			RevisionTemplate: v1alpha1.RevisionTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						autoscalingMinScaleAnnotationKey:          "0",
+						autoscalingConcurrencyTargetAnnotationKey: "100",
+					},
+				},
+				Spec: v1alpha1.RevisionSpec{
+					ConcurrencyModel: v1alpha1.RevisionRequestConcurrencyModelMulti,
+					Container: corev1.Container{
+						Image: fmt.Sprintf("%s-%d", name, generation),
+					},
+				},
+			},
+		},
+	}
+}
+
+// memoryAuditSink collects audit events delivered to it for inspection by
+// tests, instead of shipping them to a real HTTP endpoint or stdout.
+type memoryAuditSink struct {
+	received chan []byte
+}
+
+func newMemoryAuditSink() *memoryAuditSink {
+	return &memoryAuditSink{received: make(chan []byte, 16)}
+}
+
+func (m *memoryAuditSink) Send(event []byte) {
+	m.received <- event
+}
+
+// waitForEvent blocks until an audit event arrives, failing the test if
+// none shows up in time, and returns it decoded as a generic map.
+func (m *memoryAuditSink) waitForEvent(t *testing.T) map[string]interface{} {
+	t.Helper()
+	select {
+	case body := <-m.received:
+		var ev map[string]interface{}
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Fatalf("audit event was not valid JSON: %v", err)
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for audit event")
+		return nil
+	}
+}
+
+// useMemoryAuditSink swaps in a fresh in-memory sink for the duration of
+// the test and restores the previous emitter afterwards.
+func useMemoryAuditSink(t *testing.T) *memoryAuditSink {
+	t.Helper()
+	sink := newMemoryAuditSink()
+	old := defaultEmitter
+	defaultEmitter = newAuditEmitter(sink)
+	t.Cleanup(func() { defaultEmitter = old })
+	return sink
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2018 The Knative Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ValidationRule describes, for documentation purposes, one check that
+// ValidateService or ValidateServiceV1Beta1 performs.
+type ValidationRule struct {
+	// Name is a short, human-readable identifier for the rule, e.g.
+	// "runLatest.configuration.required".
+	Name string `json:"name"`
+	// Path is the dotted field path the rule validates.
+	Path string `json:"path"`
+	// Describe explains, in one line, what the rule rejects.
+	Describe string `json:"describe"`
+}
+
+// DefaultingRule describes one JSON-patch operation that SetServiceDefaults
+// or SetServiceDefaultsV1Beta1 may emit.
+type DefaultingRule struct {
+	// Name is a short, human-readable identifier for the rule.
+	Name string `json:"name"`
+	// Path is the dotted field path the rule may add or replace, with "*"
+	// standing for the service mode where the rule applies to several.
+	Path string `json:"path"`
+	// Op is the JSON-patch operation the rule emits, e.g. "add".
+	Op string `json:"op"`
+	// Describe explains where the default value comes from, e.g.
+	// "concurrencyModel -> Multi".
+	Describe string `json:"describe"`
+}
+
+// RuleRegistry is the catalog of validation and defaulting rules
+// registered for a single GroupVersionKind.
+type RuleRegistry struct {
+	GVK             schema.GroupVersionKind `json:"gvk"`
+	ValidationRules []ValidationRule        `json:"validationRules"`
+	DefaultingRules []DefaultingRule        `json:"defaultingRules"`
+}
+
+// registries holds every RuleRegistry registered by this package, keyed by
+// GVK, so the /admin/dump endpoint can enumerate them without reading
+// source.
+var registries = map[schema.GroupVersionKind]*RuleRegistry{}
+
+func registerRules(gvk schema.GroupVersionKind, validation []ValidationRule, defaulting []DefaultingRule) {
+	registries[gvk] = &RuleRegistry{
+		GVK:             gvk,
+		ValidationRules: validation,
+		DefaultingRules: defaulting,
+	}
+}
+
+// init registers the rule catalogs the /admin/dump endpoint serves. Each
+// catalog is derived directly from the rule lists ValidateService,
+// SetServiceDefaults, and their v1beta1 counterparts execute, in service.go
+// and service_v1beta1.go, so this registration can never drift from what
+// the webhook actually enforces.
+func init() {
+	registerRules(serviceGVKV1Alpha1, v1alpha1ServiceRuleCatalog(), v1alpha1ServiceDefaultingRuleCatalog())
+	registerRules(serviceGVKV1Beta1, v1beta1ServiceRuleCatalog(), v1beta1ServiceDefaultingRuleCatalog())
+}
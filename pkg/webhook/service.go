@@ -0,0 +1,516 @@
+/*
+Copyright 2018 The Knative Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"github.com/mattbaird/jsonpatch"
+)
+
+// Annotation keys recognized on the RevisionTemplate of a Service's
+// configuration. These mirror the knobs that clients such as `kn` already
+// expose to users and let the webhook validate and default them in one
+// place instead of leaving every client to reimplement the same checks.
+const (
+	autoscalingMinScaleAnnotationKey          = "autoscaling.knative.dev/minScale"
+	autoscalingMaxScaleAnnotationKey          = "autoscaling.knative.dev/maxScale"
+	autoscalingConcurrencyTargetAnnotationKey = "autoscaling.knative.dev/concurrencyTarget"
+	autoscalingConcurrencyLimitAnnotationKey  = "autoscaling.knative.dev/concurrencyLimit"
+
+	defaultMinScale = 0
+)
+
+// ValidateService is responsible for validating the creation and update of
+// v1alpha1.Service resources.
+func ValidateService(ctx context.Context) func(context.Context, *v1alpha1.Service, *v1alpha1.Service) *v1alpha1.FieldError {
+	return func(ctx context.Context, old, new *v1alpha1.Service) *v1alpha1.FieldError {
+		ferr := validateServiceSpec(&new.Spec)
+		emitValidationAudit(ctx, serviceGVKV1Alpha1, new.Namespace, new.Name, ferr)
+		return ferr
+	}
+}
+
+// serviceValidationRule pairs the documentation the /admin/dump endpoint
+// shows for a check with the function that actually performs it, so the two
+// can never drift apart: add a rule here and it is simultaneously enforced
+// and cataloged.
+type serviceValidationRule struct {
+	ValidationRule
+	check func(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError
+}
+
+// v1alpha1ServiceValidationRules are the checks validateServiceSpec runs, in
+// order, against the runLatest, pinned, and release shapes. Every check is
+// gated on the mode it applies to, so only the active mode's rules ever
+// fire; the exactly-one-mode rule guarantees at most one mode is active.
+var v1alpha1ServiceValidationRules = []serviceValidationRule{
+	{
+		ValidationRule: ValidationRule{
+			Name:     "service.exactlyOneMode",
+			Path:     "spec.runLatest,spec.pinned,spec.release",
+			Describe: "exactly one of runLatest, pinned, or release must be set",
+		},
+		check: func(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+			set := 0
+			if spec.RunLatest != nil {
+				set++
+			}
+			if spec.Pinned != nil {
+				set++
+			}
+			if spec.Release != nil {
+				set++
+			}
+			if set != 1 {
+				message := "Expected exactly one, got neither"
+				if set > 1 {
+					message = "Expected exactly one, got more than one"
+				}
+				return &v1alpha1.FieldError{
+					Message: message,
+					Paths:   []string{"spec.runLatest", "spec.pinned", "spec.release"},
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "runLatest.configuration.required",
+			Path:     "spec.runLatest.configuration",
+			Describe: "configuration must be set",
+		},
+		check: func(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+			if spec.RunLatest == nil {
+				return nil
+			}
+			var empty v1alpha1.ConfigurationSpec
+			if equality(spec.RunLatest.Configuration, empty) {
+				return &v1alpha1.FieldError{Message: "missing field(s)", Paths: []string{"spec.runLatest.configuration"}}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "pinned.revisionName.required",
+			Path:     "spec.pinned.revisionName",
+			Describe: "revisionName must be set",
+		},
+		check: func(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+			if spec.Pinned == nil {
+				return nil
+			}
+			if spec.Pinned.RevisionName == "" {
+				return &v1alpha1.FieldError{Message: "missing field(s)", Paths: []string{"spec.pinned.revisionName"}}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "pinned.configuration.required",
+			Path:     "spec.pinned.configuration",
+			Describe: "configuration must be set",
+		},
+		check: func(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+			if spec.Pinned == nil {
+				return nil
+			}
+			var empty v1alpha1.ConfigurationSpec
+			if equality(spec.Pinned.Configuration, empty) {
+				return &v1alpha1.FieldError{Message: "missing field(s)", Paths: []string{"spec.pinned.configuration"}}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "release.rolloutPercent.range",
+			Path:     "spec.release.rolloutPercent",
+			Describe: "rolloutPercent must be between 0 and 99",
+		},
+		check: func(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+			if spec.Release == nil {
+				return nil
+			}
+			if spec.Release.RolloutPercent < 0 || spec.Release.RolloutPercent > 99 {
+				return &v1alpha1.FieldError{Message: "rolloutPercent must be between 0 and 99", Paths: []string{"spec.release.rolloutPercent"}}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "release.current.required",
+			Path:     "spec.release.current",
+			Describe: "current must be set",
+		},
+		check: func(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+			if spec.Release == nil {
+				return nil
+			}
+			if spec.Release.Current == "" {
+				return &v1alpha1.FieldError{Message: "missing field(s)", Paths: []string{"spec.release.current"}}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "release.candidate.requiredWhenRollingOut",
+			Path:     "spec.release.candidate",
+			Describe: "candidate must be set when rolloutPercent > 0",
+		},
+		check: func(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+			if spec.Release == nil {
+				return nil
+			}
+			if spec.Release.RolloutPercent > 0 && spec.Release.Candidate == "" {
+				return &v1alpha1.FieldError{Message: "missing field(s)", Paths: []string{"spec.release.candidate"}}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "release.configuration.required",
+			Path:     "spec.release.configuration",
+			Describe: "configuration must be set",
+		},
+		check: func(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+			if spec.Release == nil {
+				return nil
+			}
+			var empty v1alpha1.ConfigurationSpec
+			if equality(spec.Release.Configuration, empty) {
+				return &v1alpha1.FieldError{Message: "missing field(s)", Paths: []string{"spec.release.configuration"}}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "container.image.required",
+			Path:     "spec.*.configuration.revisionTemplate.spec.container.image",
+			Describe: "container image must be set, checked by converting to the v1beta1 shape",
+		},
+		check: validateContainerImage,
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "autoscaling.annotations",
+			Path:     "spec.*.configuration.revisionTemplate.metadata.annotations",
+			Describe: "validates the autoscaling annotations on the active mode's RevisionTemplate",
+		},
+		check: func(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+			switch {
+			case spec.RunLatest != nil:
+				return validateAutoscalingAnnotations(
+					spec.RunLatest.Configuration.RevisionTemplate.ObjectMeta.Annotations,
+					"spec.runLatest.configuration.revisionTemplate",
+				)
+			case spec.Pinned != nil:
+				return validateAutoscalingAnnotations(
+					spec.Pinned.Configuration.RevisionTemplate.ObjectMeta.Annotations,
+					"spec.pinned.configuration.revisionTemplate",
+				)
+			case spec.Release != nil:
+				return validateAutoscalingAnnotations(
+					spec.Release.Configuration.RevisionTemplate.ObjectMeta.Annotations,
+					"spec.release.configuration.revisionTemplate",
+				)
+			}
+			return nil
+		},
+	},
+}
+
+func validateServiceSpec(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+	for _, rule := range v1alpha1ServiceValidationRules {
+		if ferr := rule.check(spec); ferr != nil {
+			return ferr
+		}
+	}
+	return nil
+}
+
+// v1alpha1ServiceRuleCatalog returns the ValidationRule metadata for every
+// registered rule, for the /admin/dump endpoint. It is derived directly from
+// v1alpha1ServiceValidationRules, the same list validateServiceSpec
+// executes, so the two can never drift.
+func v1alpha1ServiceRuleCatalog() []ValidationRule {
+	rules := make([]ValidationRule, 0, len(v1alpha1ServiceValidationRules))
+	for _, r := range v1alpha1ServiceValidationRules {
+		rules = append(rules, r.ValidationRule)
+	}
+	return rules
+}
+
+// validateContainerImage checks the container image by converting spec to
+// the v1beta1 shape and applying the same non-empty image condition as the
+// v1beta1 "template.container.image.required" rule, reporting any error at
+// the active mode's v1alpha1 path.
+func validateContainerImage(spec *v1alpha1.ServiceSpec) *v1alpha1.FieldError {
+	var path string
+	switch {
+	case spec.RunLatest != nil:
+		path = "spec.runLatest"
+	case spec.Pinned != nil:
+		path = "spec.pinned"
+	case spec.Release != nil:
+		path = "spec.release"
+	default:
+		return nil
+	}
+	beta := convertV1Alpha1ToV1Beta1(spec)
+	if beta.Template.Spec.Container.Image == "" {
+		return &v1alpha1.FieldError{
+			Message: "missing field(s)",
+			Paths:   []string{path + ".configuration.revisionTemplate.spec.container.image"},
+		}
+	}
+	return nil
+}
+
+// validateAutoscalingAnnotations checks the autoscaling annotations on a
+// RevisionTemplate, rejecting non-integer or negative values and a min-scale
+// that exceeds max-scale. A max-scale of 0 is not compared against min-scale.
+func validateAutoscalingAnnotations(annotations map[string]string, path string) *v1alpha1.FieldError {
+	minScale, hasMin, ferr := parseNonNegativeIntAnnotation(annotations, autoscalingMinScaleAnnotationKey, path)
+	if ferr != nil {
+		return ferr
+	}
+	maxScale, hasMax, ferr := parseNonNegativeIntAnnotation(annotations, autoscalingMaxScaleAnnotationKey, path)
+	if ferr != nil {
+		return ferr
+	}
+	if hasMin && hasMax && maxScale > 0 && minScale > maxScale {
+		return &v1alpha1.FieldError{
+			Message: "minScale must not be greater than maxScale",
+			Paths:   []string{path + ".metadata.annotations." + autoscalingMinScaleAnnotationKey},
+		}
+	}
+	if _, _, ferr := parseNonNegativeIntAnnotation(annotations, autoscalingConcurrencyTargetAnnotationKey, path); ferr != nil {
+		return ferr
+	}
+	if _, _, ferr := parseNonNegativeIntAnnotation(annotations, autoscalingConcurrencyLimitAnnotationKey, path); ferr != nil {
+		return ferr
+	}
+	return nil
+}
+
+func parseNonNegativeIntAnnotation(annotations map[string]string, key, path string) (int64, bool, *v1alpha1.FieldError) {
+	raw, ok := annotations[key]
+	if !ok || raw == "" {
+		return 0, false, nil
+	}
+	val, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, false, &v1alpha1.FieldError{
+			Message: "invalid value: " + raw + ": must be an integer",
+			Paths:   []string{path + ".metadata.annotations." + key},
+		}
+	}
+	if val < 0 {
+		return 0, false, &v1alpha1.FieldError{
+			Message: "invalid value: " + raw + ": must not be negative",
+			Paths:   []string{path + ".metadata.annotations." + key},
+		}
+	}
+	return val, true, nil
+}
+
+// configDefaultingRule pairs the documentation the /admin/dump endpoint
+// shows for a default with the function that actually applies it, mirroring
+// serviceValidationRule so defaulting and validation stay equally honest.
+type configDefaultingRule struct {
+	DefaultingRule
+	apply func(patches *[]jsonpatch.JsonPatchOperation, template *v1alpha1.RevisionTemplateSpec, path string)
+}
+
+// v1alpha1ConfigDefaultingRules are the defaults setConfigurationDefaults
+// applies, in order, to the RevisionTemplate shared by runLatest, pinned,
+// and release.
+var v1alpha1ConfigDefaultingRules = []configDefaultingRule{
+	{
+		DefaultingRule: DefaultingRule{
+			Name:     "concurrencyModel.default",
+			Path:     "spec.*.configuration.revisionTemplate.spec.concurrencyModel",
+			Op:       "add",
+			Describe: "concurrencyModel -> Multi",
+		},
+		apply: func(patches *[]jsonpatch.JsonPatchOperation, template *v1alpha1.RevisionTemplateSpec, path string) {
+			if template.Spec.ConcurrencyModel == "" {
+				*patches = append(*patches, jsonpatch.JsonPatchOperation{
+					Operation: "add",
+					Path:      path + "/revisionTemplate/spec/concurrencyModel",
+					Value:     v1alpha1.RevisionRequestConcurrencyModelMulti,
+				})
+				// Match the value locally so the annotation defaulting below
+				// sees the concurrency model that will actually land on the
+				// object.
+				template.Spec.ConcurrencyModel = v1alpha1.RevisionRequestConcurrencyModelMulti
+			}
+		},
+	},
+	{
+		DefaultingRule: DefaultingRule{
+			Name:     "autoscaling.annotations.default",
+			Path:     "spec.*.configuration.revisionTemplate.metadata.annotations",
+			Op:       "add",
+			Describe: "minScale -> 0; concurrencyTarget -> 1 (Single) or 100 (Multi), from concurrencyModel",
+		},
+		apply: func(patches *[]jsonpatch.JsonPatchOperation, template *v1alpha1.RevisionTemplateSpec, path string) {
+			setAutoscalingAnnotationDefaults(patches, template, path+"/revisionTemplate")
+		},
+	},
+}
+
+// serviceDefaultingRule is the ServiceSpec-level counterpart of
+// configDefaultingRule, for defaults that apply to a mode as a whole rather
+// than to its shared RevisionTemplate.
+type serviceDefaultingRule struct {
+	DefaultingRule
+	apply func(patches *[]jsonpatch.JsonPatchOperation, spec *v1alpha1.ServiceSpec)
+}
+
+var v1alpha1ServiceDefaultingRules = []serviceDefaultingRule{
+	{
+		DefaultingRule: DefaultingRule{
+			Name:     "release.rolloutPercent.default",
+			Path:     "spec.release.rolloutPercent",
+			Op:       "add",
+			Describe: "rolloutPercent -> 0",
+		},
+		apply: func(patches *[]jsonpatch.JsonPatchOperation, spec *v1alpha1.ServiceSpec) {
+			if spec.Release != nil && spec.Release.RolloutPercent == 0 {
+				*patches = append(*patches, jsonpatch.JsonPatchOperation{
+					Operation: "add",
+					Path:      "/spec/release/rolloutPercent",
+					Value:     0,
+				})
+			}
+		},
+	},
+}
+
+// SetServiceDefaults defaults the missing fields of a v1alpha1.Service,
+// recording every change it makes as a JSON patch.
+func SetServiceDefaults(ctx context.Context) func(patches *[]jsonpatch.JsonPatchOperation, crd *v1alpha1.Service) error {
+	return func(patches *[]jsonpatch.JsonPatchOperation, crd *v1alpha1.Service) error {
+		spec := &crd.Spec
+		switch {
+		case spec.RunLatest != nil:
+			setConfigurationDefaults(patches, &spec.RunLatest.Configuration, "/spec/runLatest/configuration")
+		case spec.Pinned != nil:
+			setConfigurationDefaults(patches, &spec.Pinned.Configuration, "/spec/pinned/configuration")
+		case spec.Release != nil:
+			setConfigurationDefaults(patches, &spec.Release.Configuration, "/spec/release/configuration")
+		}
+		for _, rule := range v1alpha1ServiceDefaultingRules {
+			rule.apply(patches, spec)
+		}
+		emitDefaultedAudit(ctx, serviceGVKV1Alpha1, crd.Namespace, crd.Name, *patches)
+		return nil
+	}
+}
+
+// v1alpha1ServiceDefaultingRuleCatalog returns the DefaultingRule metadata
+// for every registered default, for the /admin/dump endpoint. It is derived
+// directly from v1alpha1ConfigDefaultingRules and v1alpha1ServiceDefaultingRules,
+// the same lists SetServiceDefaults executes, so the two can never drift.
+func v1alpha1ServiceDefaultingRuleCatalog() []DefaultingRule {
+	rules := make([]DefaultingRule, 0, len(v1alpha1ConfigDefaultingRules)+len(v1alpha1ServiceDefaultingRules))
+	for _, r := range v1alpha1ConfigDefaultingRules {
+		rules = append(rules, r.DefaultingRule)
+	}
+	for _, r := range v1alpha1ServiceDefaultingRules {
+		rules = append(rules, r.DefaultingRule)
+	}
+	return rules
+}
+
+func setConfigurationDefaults(patches *[]jsonpatch.JsonPatchOperation, cfg *v1alpha1.ConfigurationSpec, path string) {
+	template := &cfg.RevisionTemplate
+	for _, rule := range v1alpha1ConfigDefaultingRules {
+		rule.apply(patches, template, path)
+	}
+}
+
+func setAutoscalingAnnotationDefaults(patches *[]jsonpatch.JsonPatchOperation, template *v1alpha1.RevisionTemplateSpec, path string) {
+	annotations := template.ObjectMeta.Annotations
+
+	missing := map[string]string{}
+	if _, ok := annotations[autoscalingMinScaleAnnotationKey]; !ok {
+		missing[autoscalingMinScaleAnnotationKey] = strconv.Itoa(defaultMinScale)
+	}
+	if _, ok := annotations[autoscalingConcurrencyTargetAnnotationKey]; !ok {
+		missing[autoscalingConcurrencyTargetAnnotationKey] = strconv.Itoa(defaultConcurrencyTarget(template.Spec.ConcurrencyModel))
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	// If there were no annotations at all, a single patch creates the map;
+	// otherwise each missing key is added individually so we don't clobber
+	// annotations the caller already set.
+	if annotations == nil {
+		*patches = append(*patches, jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      path + "/metadata/annotations",
+			Value:     missing,
+		})
+		return
+	}
+	for _, key := range []string{autoscalingMinScaleAnnotationKey, autoscalingConcurrencyTargetAnnotationKey} {
+		value, ok := missing[key]
+		if !ok {
+			continue
+		}
+		*patches = append(*patches, jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      path + "/metadata/annotations/" + escapeJSONPointer(key),
+			Value:     value,
+		})
+	}
+}
+
+// escapeJSONPointer escapes a key for use as a JSON Pointer (RFC 6901)
+// reference token.
+func escapeJSONPointer(key string) string {
+	key = strings.ReplaceAll(key, "~", "~0")
+	return strings.ReplaceAll(key, "/", "~1")
+}
+
+// defaultConcurrencyTarget infers a concurrency-target default from the
+// revision's concurrency model: single-concurrency revisions target one
+// in-flight request, multi-concurrency revisions target one hundred.
+func defaultConcurrencyTarget(model v1alpha1.RevisionRequestConcurrencyModelType) int {
+	if model == v1alpha1.RevisionRequestConcurrencyModelSingle {
+		return 1
+	}
+	return 100
+}
+
+func equality(a, b v1alpha1.ConfigurationSpec) bool {
+	return reflect.DeepEqual(a, b)
+}
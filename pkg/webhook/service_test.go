@@ -16,11 +16,16 @@ limitations under the License.
 package webhook
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
 	. "github.com/knative/serving/pkg/logging/testing"
 	"github.com/mattbaird/jsonpatch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 func TestEmptySpec(t *testing.T) {
@@ -33,7 +38,7 @@ func TestEmptySpec(t *testing.T) {
 	}
 	want := &v1alpha1.FieldError{
 		Message: "Expected exactly one, got neither",
-		Paths:   []string{"spec.runLatest", "spec.pinned"},
+		Paths:   []string{"spec.runLatest", "spec.pinned", "spec.release"},
 	}
 	if got.Error() != want.Error() {
 		t.Errorf("ValidateService() = %v, wanted %v", got, want)
@@ -190,3 +195,500 @@ func TestLatestSetsDefaults(t *testing.T) {
 		t.Errorf("Unexpected patch: want %v, got %v", want, got)
 	}
 }
+
+func TestRunLatestFailsWithNonIntegerMinScale(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			RunLatest: &v1alpha1.RunLatestType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	s.Spec.RunLatest.Configuration.RevisionTemplate.ObjectMeta.Annotations[autoscalingMinScaleAnnotationKey] = "not-a-number"
+
+	got := ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "invalid value: not-a-number: must be an integer",
+		Paths:   []string{"spec.runLatest.configuration.revisionTemplate.metadata.annotations." + autoscalingMinScaleAnnotationKey},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateService() = %v, wanted %v", got, want)
+	}
+}
+
+func TestRunLatestFailsWithNegativeMaxScale(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			RunLatest: &v1alpha1.RunLatestType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	s.Spec.RunLatest.Configuration.RevisionTemplate.ObjectMeta.Annotations[autoscalingMaxScaleAnnotationKey] = "-1"
+
+	got := ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "invalid value: -1: must not be negative",
+		Paths:   []string{"spec.runLatest.configuration.revisionTemplate.metadata.annotations." + autoscalingMaxScaleAnnotationKey},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateService() = %v, wanted %v", got, want)
+	}
+}
+
+func TestRunLatestFailsWithNonIntegerConcurrencyTarget(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			RunLatest: &v1alpha1.RunLatestType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	s.Spec.RunLatest.Configuration.RevisionTemplate.ObjectMeta.Annotations[autoscalingConcurrencyTargetAnnotationKey] = "not-a-number"
+
+	got := ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "invalid value: not-a-number: must be an integer",
+		Paths:   []string{"spec.runLatest.configuration.revisionTemplate.metadata.annotations." + autoscalingConcurrencyTargetAnnotationKey},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateService() = %v, wanted %v", got, want)
+	}
+}
+
+func TestRunLatestFailsWithNegativeConcurrencyLimit(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			RunLatest: &v1alpha1.RunLatestType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	s.Spec.RunLatest.Configuration.RevisionTemplate.ObjectMeta.Annotations[autoscalingConcurrencyLimitAnnotationKey] = "-1"
+
+	got := ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "invalid value: -1: must not be negative",
+		Paths:   []string{"spec.runLatest.configuration.revisionTemplate.metadata.annotations." + autoscalingConcurrencyLimitAnnotationKey},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateService() = %v, wanted %v", got, want)
+	}
+}
+
+func TestPinnedFailsWithMinScaleGreaterThanMaxScale(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			Pinned: &v1alpha1.PinnedType{
+				RevisionName:  "revision",
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	s.Spec.Pinned.Configuration.RevisionTemplate.ObjectMeta.Annotations[autoscalingMinScaleAnnotationKey] = "5"
+	s.Spec.Pinned.Configuration.RevisionTemplate.ObjectMeta.Annotations[autoscalingMaxScaleAnnotationKey] = "2"
+
+	got := ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "minScale must not be greater than maxScale",
+		Paths:   []string{"spec.pinned.configuration.revisionTemplate.metadata.annotations." + autoscalingMinScaleAnnotationKey},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateService() = %v, wanted %v", got, want)
+	}
+}
+
+func TestRunLatestSetsAutoscalingAnnotationDefaults(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			RunLatest: &v1alpha1.RunLatestType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	// Drop the annotations that a previous defaulting pass would have set.
+	s.Spec.RunLatest.Configuration.RevisionTemplate.ObjectMeta.Annotations = nil
+
+	var patches []jsonpatch.JsonPatchOperation
+	if err := SetServiceDefaults(TestContextWithLogger(t))(&patches, &s); err != nil {
+		t.Errorf("Expected success, but failed with: %s", err)
+	}
+
+	expected := jsonpatch.JsonPatchOperation{
+		Operation: "add",
+		Path:      "/spec/runLatest/configuration/revisionTemplate/metadata/annotations",
+		Value: map[string]string{
+			autoscalingMinScaleAnnotationKey:          "0",
+			autoscalingConcurrencyTargetAnnotationKey: "100",
+		},
+	}
+
+	if len(patches) != 1 {
+		t.Errorf("Unexpected number of patches: want 1, got %d", len(patches))
+	} else if got, want := patches[0].Json(), expected.Json(); got != want {
+		t.Errorf("Unexpected patch: want %v, got %v", want, got)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			Release: &v1alpha1.ReleaseType{
+				Current:        "current-revision",
+				Candidate:      "candidate-revision",
+				RolloutPercent: 10,
+				Configuration:  createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+
+	if err := ValidateService(TestContextWithLogger(t))(nil, &s, &s); err != nil {
+		t.Errorf("Expected success, but failed with: %s", err)
+	}
+}
+
+func TestReleaseFailsWithNoCurrent(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			Release: &v1alpha1.ReleaseType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+
+	got := ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "missing field(s)",
+		Paths:   []string{"spec.release.current"},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateService() = %v, wanted %v", got, want)
+	}
+}
+
+func TestReleaseFailsWithNoCandidateWhenRollingOut(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			Release: &v1alpha1.ReleaseType{
+				Current:        "current-revision",
+				RolloutPercent: 10,
+				Configuration:  createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+
+	got := ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "missing field(s)",
+		Paths:   []string{"spec.release.candidate"},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateService() = %v, wanted %v", got, want)
+	}
+}
+
+func TestReleaseFailsWithBadPercent(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			Release: &v1alpha1.ReleaseType{
+				Current:        "current-revision",
+				Candidate:      "candidate-revision",
+				RolloutPercent: 100,
+				Configuration:  createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+
+	got := ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "rolloutPercent must be between 0 and 99",
+		Paths:   []string{"spec.release.rolloutPercent"},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateService() = %v, wanted %v", got, want)
+	}
+}
+
+func TestReleaseFailsWithNoConfiguration(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			Release: &v1alpha1.ReleaseType{
+				Current: "current-revision",
+			},
+		},
+	}
+
+	got := ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "missing field(s)",
+		Paths:   []string{"spec.release.configuration"},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateService() = %v, wanted %v", got, want)
+	}
+}
+
+func TestReleaseSetsDefaults(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			Release: &v1alpha1.ReleaseType{
+				Current: "current-revision",
+				// Non-zero so the rolloutPercent default below doesn't fire
+				// and this test only exercises the concurrencyModel default.
+				RolloutPercent: 10,
+				Candidate:      "candidate-revision",
+				Configuration:  createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+
+	// Drop the ConcurrencyModel.
+	s.Spec.Release.Configuration.RevisionTemplate.Spec.ConcurrencyModel = ""
+
+	var patches []jsonpatch.JsonPatchOperation
+	if err := SetServiceDefaults(TestContextWithLogger(t))(&patches, &s); err != nil {
+		t.Errorf("Expected success, but failed with: %s", err)
+	}
+
+	expected := jsonpatch.JsonPatchOperation{
+		Operation: "add",
+		Path:      "/spec/release/configuration/revisionTemplate/spec/concurrencyModel",
+		Value:     v1alpha1.RevisionRequestConcurrencyModelMulti,
+	}
+
+	if len(patches) != 1 {
+		t.Errorf("Unexpected number of patches: want 1, got %d", len(patches))
+	} else if got, want := patches[0].Json(), expected.Json(); got != want {
+		t.Errorf("Unexpected patch: want %v, got %v", want, got)
+	}
+}
+
+func TestReleaseSetsRolloutPercentDefault(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			Release: &v1alpha1.ReleaseType{
+				Current:       "current-revision",
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+
+	var patches []jsonpatch.JsonPatchOperation
+	if err := SetServiceDefaults(TestContextWithLogger(t))(&patches, &s); err != nil {
+		t.Errorf("Expected success, but failed with: %s", err)
+	}
+
+	expected := jsonpatch.JsonPatchOperation{
+		Operation: "add",
+		Path:      "/spec/release/rolloutPercent",
+		Value:     0,
+	}
+
+	if len(patches) != 1 {
+		t.Errorf("Unexpected number of patches: want 1, got %d", len(patches))
+	} else if got, want := patches[0].Json(), expected.Json(); got != want {
+		t.Errorf("Unexpected patch: want %v, got %v", want, got)
+	}
+}
+
+func TestEmptySpecEmitsRejectedAuditEvent(t *testing.T) {
+	sink := useMemoryAuditSink(t)
+
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{},
+	}
+	ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+
+	ev := sink.waitForEvent(t)
+	if got, want := ev["type"], eventTypeRejected; got != want {
+		t.Errorf("event type = %v, want %v", got, want)
+	}
+}
+
+func TestRunLatestEmitsValidatedAuditEvent(t *testing.T) {
+	sink := useMemoryAuditSink(t)
+
+	s := v1alpha1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "my-service"},
+		Spec: v1alpha1.ServiceSpec{
+			RunLatest: &v1alpha1.RunLatestType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+
+	ev := sink.waitForEvent(t)
+	if got, want := ev["type"], eventTypeValidated; got != want {
+		t.Errorf("event type = %v, want %v", got, want)
+	}
+	if got, want := ev["subject"], "default/my-service"; got != want {
+		t.Errorf("event subject = %v, want %v", got, want)
+	}
+}
+
+func TestPinnedSetsDefaultsEmitsDefaultedAuditEvent(t *testing.T) {
+	sink := useMemoryAuditSink(t)
+
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			Pinned: &v1alpha1.PinnedType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	s.Spec.Pinned.Configuration.RevisionTemplate.Spec.ConcurrencyModel = ""
+
+	var patches []jsonpatch.JsonPatchOperation
+	SetServiceDefaults(TestContextWithLogger(t))(&patches, &s)
+
+	ev := sink.waitForEvent(t)
+	if got, want := ev["type"], eventTypeDefaulted; got != want {
+		t.Errorf("event type = %v, want %v", got, want)
+	}
+}
+
+func TestAdminDumpIncludesRunLatestAndPinnedRules(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, AdminDumpPath, nil)
+	rec := httptest.NewRecorder()
+	DumpHandler().ServeHTTP(rec, req)
+
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+
+	var resp struct {
+		Registries []struct {
+			GVK             schema.GroupVersionKind `json:"gvk"`
+			ValidationRules []struct {
+				Path string `json:"path"`
+			} `json:"validationRules"`
+		} `json:"registries"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid dump response JSON: %v", err)
+	}
+
+	var v1alpha1Paths []string
+	for _, reg := range resp.Registries {
+		if reg.GVK != serviceGVKV1Alpha1 {
+			continue
+		}
+		for _, rule := range reg.ValidationRules {
+			v1alpha1Paths = append(v1alpha1Paths, rule.Path)
+		}
+	}
+
+	for _, want := range []string{"spec.runLatest.configuration", "spec.pinned.revisionName"} {
+		found := false
+		for _, got := range v1alpha1Paths {
+			if got == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected dump to include rule path %q, got %v", want, v1alpha1Paths)
+		}
+	}
+}
+
+func TestRunLatestFailsWithNoContainerImage(t *testing.T) {
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			RunLatest: &v1alpha1.RunLatestType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	s.Spec.RunLatest.Configuration.RevisionTemplate.Spec.Container.Image = ""
+
+	got := ValidateService(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "missing field(s)",
+		Paths:   []string{"spec.runLatest.configuration.revisionTemplate.spec.container.image"},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateService() = %v, wanted %v", got, want)
+	}
+}
+
+func TestRunLatestEmitsValidatedAuditEventWithUserInfo(t *testing.T) {
+	sink := useMemoryAuditSink(t)
+
+	s := v1alpha1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "my-service"},
+		Spec: v1alpha1.ServiceSpec{
+			RunLatest: &v1alpha1.RunLatestType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	ctx := WithUserInfo(TestContextWithLogger(t), "alice@example.com")
+	ValidateService(ctx)(ctx, &s, &s)
+
+	ev := sink.waitForEvent(t)
+	data, ok := ev["data"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("event data was not an object: %v", ev["data"])
+	}
+	if got, want := data["userInfo"], "alice@example.com"; got != want {
+		t.Errorf("event userInfo = %v, want %v", got, want)
+	}
+}
+
+func TestPinnedSetsDefaultsEmitsDefaultedAuditEventWithUserInfo(t *testing.T) {
+	sink := useMemoryAuditSink(t)
+
+	s := v1alpha1.Service{
+		Spec: v1alpha1.ServiceSpec{
+			Pinned: &v1alpha1.PinnedType{
+				Configuration: createConfiguration(1, "config").Spec,
+			},
+		},
+	}
+	s.Spec.Pinned.Configuration.RevisionTemplate.Spec.ConcurrencyModel = ""
+
+	ctx := WithUserInfo(TestContextWithLogger(t), "alice@example.com")
+	var patches []jsonpatch.JsonPatchOperation
+	SetServiceDefaults(ctx)(&patches, &s)
+
+	ev := sink.waitForEvent(t)
+	data, ok := ev["data"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("event data was not an object: %v", ev["data"])
+	}
+	if got, want := data["userInfo"], "alice@example.com"; got != want {
+		t.Errorf("event userInfo = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2018 The Knative Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"github.com/knative/serving/pkg/apis/serving/v1beta1"
+	"github.com/mattbaird/jsonpatch"
+)
+
+const defaultTimeoutSeconds = 300
+
+// ValidateServiceV1Beta1 is responsible for validating the creation and
+// update of v1beta1.Service resources, the flattened single-template
+// shape that superseded runLatest/pinned/release.
+func ValidateServiceV1Beta1(ctx context.Context) func(context.Context, *v1beta1.Service, *v1beta1.Service) *v1alpha1.FieldError {
+	return func(ctx context.Context, old, new *v1beta1.Service) *v1alpha1.FieldError {
+		ferr := validateServiceSpecV1Beta1(&new.Spec)
+		emitValidationAudit(ctx, serviceGVKV1Beta1, new.Namespace, new.Name, ferr)
+		return ferr
+	}
+}
+
+// serviceValidationRuleV1Beta1 is the v1beta1 counterpart of
+// serviceValidationRule: it binds the /admin/dump documentation for a check
+// directly to the function that performs it.
+type serviceValidationRuleV1Beta1 struct {
+	ValidationRule
+	check func(spec *v1beta1.ServiceSpec) *v1alpha1.FieldError
+}
+
+// v1beta1ServiceValidationRules are the checks validateServiceSpecV1Beta1
+// runs, in order.
+var v1beta1ServiceValidationRules = []serviceValidationRuleV1Beta1{
+	{
+		ValidationRule: ValidationRule{
+			Name:     "template.container.image.required",
+			Path:     "spec.template.spec.container.image",
+			Describe: "container image must be set",
+		},
+		check: func(spec *v1beta1.ServiceSpec) *v1alpha1.FieldError {
+			if spec.Template.Spec.Container.Image == "" {
+				return &v1alpha1.FieldError{Message: "missing field(s)", Paths: []string{"spec.template.spec.container.image"}}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "traffic.revisionNameXorLatestRevision",
+			Path:     "spec.traffic[*]",
+			Describe: "revisionName and latestRevision are mutually exclusive",
+		},
+		check: func(spec *v1beta1.ServiceSpec) *v1alpha1.FieldError {
+			for i, t := range spec.Traffic {
+				if t.RevisionName != "" && t.LatestRevision != nil && *t.LatestRevision {
+					return &v1alpha1.FieldError{
+						Message: "revisionName and latestRevision are mutually exclusive",
+						Paths:   []string{fmt.Sprintf("spec.traffic[%d]", i)},
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "traffic.atMostOneLatestRevision",
+			Path:     "spec.traffic",
+			Describe: "at most one traffic target may set latestRevision: true",
+		},
+		check: func(spec *v1beta1.ServiceSpec) *v1alpha1.FieldError {
+			count := 0
+			for _, t := range spec.Traffic {
+				if t.LatestRevision != nil && *t.LatestRevision {
+					count++
+				}
+			}
+			if count > 1 {
+				return &v1alpha1.FieldError{Message: "at most one traffic target may set latestRevision: true", Paths: []string{"spec.traffic"}}
+			}
+			return nil
+		},
+	},
+	{
+		ValidationRule: ValidationRule{
+			Name:     "traffic.percentSumsTo100",
+			Path:     "spec.traffic",
+			Describe: "traffic percentages must sum to 100 when traffic is set",
+		},
+		check: func(spec *v1beta1.ServiceSpec) *v1alpha1.FieldError {
+			if len(spec.Traffic) == 0 {
+				return nil
+			}
+			total := 0
+			for _, t := range spec.Traffic {
+				total += t.Percent
+			}
+			if total != 100 {
+				return &v1alpha1.FieldError{Message: "traffic percentages must sum to 100", Paths: []string{"spec.traffic"}}
+			}
+			return nil
+		},
+	},
+}
+
+func validateServiceSpecV1Beta1(spec *v1beta1.ServiceSpec) *v1alpha1.FieldError {
+	for _, rule := range v1beta1ServiceValidationRules {
+		if ferr := rule.check(spec); ferr != nil {
+			return ferr
+		}
+	}
+	return nil
+}
+
+// v1beta1ServiceRuleCatalog returns the ValidationRule metadata for every
+// registered rule, derived directly from v1beta1ServiceValidationRules so
+// the /admin/dump endpoint can never drift from validateServiceSpecV1Beta1.
+func v1beta1ServiceRuleCatalog() []ValidationRule {
+	rules := make([]ValidationRule, 0, len(v1beta1ServiceValidationRules))
+	for _, r := range v1beta1ServiceValidationRules {
+		rules = append(rules, r.ValidationRule)
+	}
+	return rules
+}
+
+// serviceDefaultingRuleV1Beta1 is the v1beta1 counterpart of
+// serviceDefaultingRule: it binds the /admin/dump documentation for a
+// default directly to the function that applies it.
+type serviceDefaultingRuleV1Beta1 struct {
+	DefaultingRule
+	apply func(patches *[]jsonpatch.JsonPatchOperation, spec *v1beta1.ServiceSpec)
+}
+
+// v1beta1ServiceDefaultingRules are the defaults SetServiceDefaultsV1Beta1
+// applies, in order.
+var v1beta1ServiceDefaultingRules = []serviceDefaultingRuleV1Beta1{
+	{
+		DefaultingRule: DefaultingRule{
+			Name:     "containerConcurrency.default",
+			Path:     "spec.template.spec.containerConcurrency",
+			Op:       "add",
+			Describe: "containerConcurrency -> 0 (multi)",
+		},
+		apply: func(patches *[]jsonpatch.JsonPatchOperation, spec *v1beta1.ServiceSpec) {
+			if spec.Template.Spec.ContainerConcurrency == 0 {
+				*patches = append(*patches, jsonpatch.JsonPatchOperation{
+					Operation: "add",
+					Path:      "/spec/template/spec/containerConcurrency",
+					Value:     0,
+				})
+			}
+		},
+	},
+	{
+		DefaultingRule: DefaultingRule{
+			Name:     "timeoutSeconds.default",
+			Path:     "spec.template.spec.timeoutSeconds",
+			Op:       "add",
+			Describe: "timeoutSeconds -> 300",
+		},
+		apply: func(patches *[]jsonpatch.JsonPatchOperation, spec *v1beta1.ServiceSpec) {
+			if spec.Template.Spec.TimeoutSeconds == 0 {
+				*patches = append(*patches, jsonpatch.JsonPatchOperation{
+					Operation: "add",
+					Path:      "/spec/template/spec/timeoutSeconds",
+					Value:     defaultTimeoutSeconds,
+				})
+			}
+		},
+	},
+	{
+		DefaultingRule: DefaultingRule{
+			Name:     "traffic.default",
+			Path:     "spec.traffic",
+			Op:       "add",
+			Describe: "traffic -> 100% latestRevision",
+		},
+		apply: func(patches *[]jsonpatch.JsonPatchOperation, spec *v1beta1.ServiceSpec) {
+			if len(spec.Traffic) == 0 {
+				latest := true
+				*patches = append(*patches, jsonpatch.JsonPatchOperation{
+					Operation: "add",
+					Path:      "/spec/traffic",
+					Value: []v1beta1.TrafficTarget{{
+						LatestRevision: &latest,
+						Percent:        100,
+					}},
+				})
+			}
+		},
+	},
+}
+
+// SetServiceDefaultsV1Beta1 defaults the missing fields of a v1beta1.Service.
+func SetServiceDefaultsV1Beta1(ctx context.Context) func(patches *[]jsonpatch.JsonPatchOperation, crd *v1beta1.Service) error {
+	return func(patches *[]jsonpatch.JsonPatchOperation, crd *v1beta1.Service) error {
+		spec := &crd.Spec
+		for _, rule := range v1beta1ServiceDefaultingRules {
+			rule.apply(patches, spec)
+		}
+		emitDefaultedAudit(ctx, serviceGVKV1Beta1, crd.Namespace, crd.Name, *patches)
+		return nil
+	}
+}
+
+// v1beta1ServiceDefaultingRuleCatalog returns the DefaultingRule metadata
+// for every registered default, derived directly from
+// v1beta1ServiceDefaultingRules so the /admin/dump endpoint can never drift
+// from SetServiceDefaultsV1Beta1.
+func v1beta1ServiceDefaultingRuleCatalog() []DefaultingRule {
+	rules := make([]DefaultingRule, 0, len(v1beta1ServiceDefaultingRules))
+	for _, r := range v1beta1ServiceDefaultingRules {
+		rules = append(rules, r.DefaultingRule)
+	}
+	return rules
+}
+
+// convertV1Alpha1ToV1Beta1 flattens a v1alpha1.ServiceSpec's runLatest,
+// pinned, or release shape into the single-template v1beta1.ServiceSpec
+// shape, so the two APIs can share one set of validation rules.
+func convertV1Alpha1ToV1Beta1(spec *v1alpha1.ServiceSpec) *v1beta1.ServiceSpec {
+	out := &v1beta1.ServiceSpec{}
+	switch {
+	case spec.RunLatest != nil:
+		out.Template = spec.RunLatest.Configuration.RevisionTemplate
+		latest := true
+		out.Traffic = []v1beta1.TrafficTarget{{LatestRevision: &latest, Percent: 100}}
+	case spec.Pinned != nil:
+		out.Template = spec.Pinned.Configuration.RevisionTemplate
+		out.Traffic = []v1beta1.TrafficTarget{{RevisionName: spec.Pinned.RevisionName, Percent: 100}}
+	case spec.Release != nil:
+		out.Template = spec.Release.Configuration.RevisionTemplate
+		out.Traffic = releaseTraffic(spec.Release)
+	}
+	return out
+}
+
+func releaseTraffic(r *v1alpha1.ReleaseType) []v1beta1.TrafficTarget {
+	if r.RolloutPercent == 0 || r.Candidate == "" {
+		return []v1beta1.TrafficTarget{{RevisionName: r.Current, Percent: 100}}
+	}
+	return []v1beta1.TrafficTarget{
+		{RevisionName: r.Current, Percent: 100 - r.RolloutPercent},
+		{RevisionName: r.Candidate, Percent: r.RolloutPercent},
+	}
+}
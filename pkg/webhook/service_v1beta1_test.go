@@ -0,0 +1,226 @@
+/*
+Copyright 2018 The Knative Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"testing"
+
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"github.com/knative/serving/pkg/apis/serving/v1beta1"
+	. "github.com/knative/serving/pkg/logging/testing"
+	"github.com/mattbaird/jsonpatch"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func createServiceSpecV1Beta1(image string) v1beta1.ServiceSpec {
+	return v1beta1.ServiceSpec{
+		Template: v1alpha1.RevisionTemplateSpec{
+			Spec: v1alpha1.RevisionSpec{
+				Container: corev1.Container{Image: image},
+			},
+		},
+	}
+}
+
+func TestEmptySpecV1Beta1(t *testing.T) {
+	s := v1beta1.Service{
+		Spec: v1beta1.ServiceSpec{},
+	}
+	got := ValidateServiceV1Beta1(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "missing field(s)",
+		Paths:   []string{"spec.template.spec.container.image"},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateServiceV1Beta1() = %v, wanted %v", got, want)
+	}
+}
+
+func TestServiceV1Beta1(t *testing.T) {
+	s := v1beta1.Service{
+		Spec: createServiceSpecV1Beta1("busybox"),
+	}
+	s.Spec.Traffic = []v1beta1.TrafficTarget{{RevisionName: "busybox-00001", Percent: 100}}
+
+	if err := ValidateServiceV1Beta1(TestContextWithLogger(t))(nil, &s, &s); err != nil {
+		t.Errorf("Expected success, but failed with: %s", err)
+	}
+}
+
+func TestServiceV1Beta1FailsWithTwoLatestRevisionTargets(t *testing.T) {
+	s := v1beta1.Service{
+		Spec: createServiceSpecV1Beta1("busybox"),
+	}
+	latest := true
+	s.Spec.Traffic = []v1beta1.TrafficTarget{
+		{LatestRevision: &latest, Percent: 50},
+		{LatestRevision: &latest, Percent: 50},
+	}
+
+	got := ValidateServiceV1Beta1(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "at most one traffic target may set latestRevision: true",
+		Paths:   []string{"spec.traffic"},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateServiceV1Beta1() = %v, wanted %v", got, want)
+	}
+}
+
+func TestServiceV1Beta1FailsWithBadPercentages(t *testing.T) {
+	s := v1beta1.Service{
+		Spec: createServiceSpecV1Beta1("busybox"),
+	}
+	s.Spec.Traffic = []v1beta1.TrafficTarget{{RevisionName: "busybox-00001", Percent: 50}}
+
+	got := ValidateServiceV1Beta1(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "traffic percentages must sum to 100",
+		Paths:   []string{"spec.traffic"},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateServiceV1Beta1() = %v, wanted %v", got, want)
+	}
+}
+
+func TestServiceV1Beta1FailsWithRevisionNameAndLatestRevision(t *testing.T) {
+	s := v1beta1.Service{
+		Spec: createServiceSpecV1Beta1("busybox"),
+	}
+	latest := true
+	s.Spec.Traffic = []v1beta1.TrafficTarget{{RevisionName: "busybox-00001", LatestRevision: &latest, Percent: 100}}
+
+	got := ValidateServiceV1Beta1(TestContextWithLogger(t))(nil, &s, &s)
+	if got == nil {
+		t.Errorf("Expected failure, but succeeded with: %+v", s)
+	}
+	want := &v1alpha1.FieldError{
+		Message: "revisionName and latestRevision are mutually exclusive",
+		Paths:   []string{"spec.traffic[0]"},
+	}
+	if got.Error() != want.Error() {
+		t.Errorf("ValidateServiceV1Beta1() = %v, wanted %v", got, want)
+	}
+}
+
+func TestServiceV1Beta1SetsDefaults(t *testing.T) {
+	s := v1beta1.Service{
+		Spec: createServiceSpecV1Beta1("busybox"),
+	}
+
+	var patches []jsonpatch.JsonPatchOperation
+	if err := SetServiceDefaultsV1Beta1(TestContextWithLogger(t))(&patches, &s); err != nil {
+		t.Errorf("Expected success, but failed with: %s", err)
+	}
+
+	wantPaths := map[string]bool{
+		"/spec/template/spec/containerConcurrency": false,
+		"/spec/template/spec/timeoutSeconds":       false,
+		"/spec/traffic":                            false,
+	}
+	for _, p := range patches {
+		if _, ok := wantPaths[p.Path]; !ok {
+			t.Errorf("Unexpected patch path: %s", p.Path)
+			continue
+		}
+		wantPaths[p.Path] = true
+	}
+	for path, seen := range wantPaths {
+		if !seen {
+			t.Errorf("Expected a default patch for %s", path)
+		}
+	}
+}
+
+func TestConvertV1Alpha1ToV1Beta1(t *testing.T) {
+	alpha := v1alpha1.ServiceSpec{
+		Pinned: &v1alpha1.PinnedType{
+			RevisionName:  "revision",
+			Configuration: createConfiguration(1, "config").Spec,
+		},
+	}
+
+	beta := convertV1Alpha1ToV1Beta1(&alpha)
+	if got, want := len(beta.Traffic), 1; got != want {
+		t.Fatalf("len(beta.Traffic) = %d, want %d", got, want)
+	}
+	if got, want := beta.Traffic[0].RevisionName, "revision"; got != want {
+		t.Errorf("beta.Traffic[0].RevisionName = %s, want %s", got, want)
+	}
+	if got, want := beta.Traffic[0].Percent, 100; got != want {
+		t.Errorf("beta.Traffic[0].Percent = %d, want %d", got, want)
+	}
+}
+
+func TestServiceV1Beta1EmitsValidatedAuditEvent(t *testing.T) {
+	sink := useMemoryAuditSink(t)
+
+	s := v1beta1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "my-service"},
+		Spec:       createServiceSpecV1Beta1("busybox"),
+	}
+	s.Spec.Traffic = []v1beta1.TrafficTarget{{RevisionName: "busybox-00001", Percent: 100}}
+
+	ValidateServiceV1Beta1(TestContextWithLogger(t))(nil, &s, &s)
+
+	ev := sink.waitForEvent(t)
+	if got, want := ev["type"], eventTypeValidated; got != want {
+		t.Errorf("event type = %v, want %v", got, want)
+	}
+	if got, want := ev["subject"], "default/my-service"; got != want {
+		t.Errorf("event subject = %v, want %v", got, want)
+	}
+}
+
+func TestServiceV1Beta1EmitsRejectedAuditEvent(t *testing.T) {
+	sink := useMemoryAuditSink(t)
+
+	s := v1beta1.Service{
+		Spec: v1beta1.ServiceSpec{},
+	}
+	ValidateServiceV1Beta1(TestContextWithLogger(t))(nil, &s, &s)
+
+	ev := sink.waitForEvent(t)
+	if got, want := ev["type"], eventTypeRejected; got != want {
+		t.Errorf("event type = %v, want %v", got, want)
+	}
+}
+
+func TestServiceV1Beta1SetsDefaultsEmitsDefaultedAuditEvent(t *testing.T) {
+	sink := useMemoryAuditSink(t)
+
+	s := v1beta1.Service{
+		Spec: createServiceSpecV1Beta1("busybox"),
+	}
+
+	var patches []jsonpatch.JsonPatchOperation
+	SetServiceDefaultsV1Beta1(TestContextWithLogger(t))(&patches, &s)
+
+	ev := sink.waitForEvent(t)
+	if got, want := ev["type"], eventTypeDefaulted; got != want {
+		t.Errorf("event type = %v, want %v", got, want)
+	}
+}